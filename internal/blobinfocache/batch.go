@@ -0,0 +1,26 @@
+package blobinfocache
+
+import (
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// BatchWriter accumulates Record* calls within a single BatchUpdate invocation, so that a cache implementation
+// can apply them using one underlying transaction instead of the one-transaction-per-call cost each Record*
+// method on BlobInfoCache pays when used on its own.
+type BatchWriter interface {
+	RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest)
+	RecordTOCUncompressedPair(tocDigest digest.Digest, uncompressed digest.Digest)
+	RecordDigestCompressorData(anyDigest digest.Digest, data DigestCompressorData)
+	RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference)
+}
+
+// BatchingCache is implemented by BlobInfoCache implementations that can coalesce a batch of Record* calls,
+// performed by fn against the BatchWriter it is given, into a single underlying transaction.
+//
+// TODO: Only pkg/blobinfocache/boltdb implements this so far. The sqlite and in-memory implementations, and
+// copy/compression.go's recordValidatedDigestData (the main caller this was meant for), still need to be updated
+// to use it; callers that type-assert for BatchingCache must keep tolerating its absence until then.
+type BatchingCache interface {
+	BatchUpdate(fn func(BatchWriter) error) error
+}
@@ -0,0 +1,14 @@
+package blobinfocache
+
+import "io"
+
+// ImportExport is implemented by BlobInfoCache implementations that can serialize their entire contents to, and
+// merge previously-serialized contents from, a stream — e.g. to pre-seed a cache in CI, or to share a warmed
+// cache across build farm workers.
+//
+// TODO: Only pkg/blobinfocache/boltdb implements this so far; pre-seeding a build farm worker configured to use
+// the sqlite or in-memory cache isn't possible until those gain an equivalent Export/Import.
+type ImportExport interface {
+	Export(w io.Writer) error
+	Import(r io.Reader) error
+}
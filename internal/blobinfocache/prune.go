@@ -0,0 +1,13 @@
+package blobinfocache
+
+import "time"
+
+// Pruner is implemented by BlobInfoCache implementations that can explicitly delete knownLocations entries older
+// than a given age, e.g. as part of an out-of-band maintenance command.
+//
+// TODO: Only pkg/blobinfocache/boltdb implements this so far; the sqlite implementation needs an equivalent
+// PruneOlderThan before a maintenance command built on this interface can rely on it regardless of which cache
+// backend is configured.
+type Pruner interface {
+	PruneOlderThan(d time.Duration) error
+}
@@ -0,0 +1,10 @@
+package blobinfocache
+
+import "github.com/opencontainers/go-digest"
+
+// TOCResolver is implemented by BlobInfoCache implementations that can atomically look up, or compute and record,
+// the uncompressed digest corresponding to a TOC digest, so that concurrent callers resolving the same TOC (e.g.
+// concurrent zstd:chunked partial pulls) don’t redundantly recompute it.
+type TOCResolver interface {
+	LookupOrRecordTOC(tocDigest digest.Digest, computeFn func() (digest.Digest, error)) (digest.Digest, error)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"math"
 	"sync"
 	"time"
 
@@ -42,8 +43,24 @@ var (
 	// knownLocationsBucket stores a nested structure of buckets, keyed by (transport name, scope string, blob digest), ultimately containing
 	// a bucket of (opaque location reference, BinaryMarshaller-encoded time.Time value).
 	knownLocationsBucket = []byte("knownLocations")
+	// knownDigestsBucket stores, for every digest this cache has ever been told about via RecordDigestCompressorData
+	// or RecordKnownLocation (regardless of transport or scope), a BinaryMarshaller-encoded time.Time of the most
+	// recent such call (or, for imported data, the imported record’s own time). PruneOlderThan (and the
+	// opportunistic pruning enabled by NewWithMaxAge) expire entries here alongside knownLocations.
+	// CandidateLocations2 consults this bucket (see appendReplacementCandidates), but an entry here does not, on
+	// its own, make a digest a candidate: a digest with no recorded compression is never suggested by
+	// CandidateLocations2, and one with recorded compression is suggested with an unknown location whether or not
+	// it has an entry here.
+	knownDigestsBucket = []byte("knownDigests")
 )
 
+// pruneCursorKey is a reserved leaf key used, within a bucket otherwise keyed by digest or location, to remember
+// where a bounded, resumable prune (see pruneLocationsOlderThan and pruneStaleMarkers) last left off. It is not a
+// valid digest string (it starts with a NUL byte, which no digest.Digest.String() produces), so it can never
+// collide with a real entry, and the existing “is this a sub-bucket?” / “can this be parsed as a digest?” checks
+// elsewhere in this file already skip over it.
+var pruneCursorKey = []byte("\x00pruneCursor")
+
 // Concurrency:
 // See https://www.sqlite.org/src/artifact/c230a7a24?ln=994-1081 for all the issues with locks, which make it extremely
 // difficult to use a single BoltDB file from multiple threads/goroutines inside a process.  So, we punt and only allow one at a time.
@@ -99,10 +116,63 @@ func unlockPath(path string) {
 
 // cache is a BlobInfoCache implementation which uses a BoltDB file at the specified path.
 //
-// Note that we don’t keep the database open across operations, because that would lock the file and block any other
-// users; instead, we need to open/close it for every single write or lookup.
+// By default we don’t keep the database open across operations, because that would lock the file and block any
+// other users; instead, we open/close it for every single write or lookup. Callers that expect to make many calls
+// in a row (e.g. the copy/compression code recording dozens of digests for a single image) can bracket them with
+// Open()/Close() to keep the *bolt.DB handle (and the exclusive pathLock below) live for the whole session instead.
 type cache struct {
 	path string
+
+	// maxAge, if nonzero, makes RecordKnownLocation opportunistically prune knownLocations entries older than
+	// maxAge from the (transport, scope) it just touched, bounded to a small amount of work per call (see
+	// opportunisticPruneBudget) so that a long-running process converges over time without needing an explicit
+	// maintenance step. See PruneOlderThan for an explicit, unbounded sweep.
+	maxAge time.Duration
+}
+
+// openDBEntry is a refcounted, kept-open *bolt.DB for a single path, shared by every *cache with an outstanding
+// Open() for that path. mutex serializes Open()/Close()/lookups for this path only, so that opening one path
+// (including the potentially slow lockPath+bolt.Open below) never blocks callers using a different path.
+type openDBEntry struct {
+	mutex    sync.Mutex
+	db       *bolt.DB // nil until the first successful Open() for this path sets it
+	refCount int
+	closed   bool // set by Close() once this entry has been removed from openDBEntries; see Open().
+}
+
+var (
+	// openDBEntries contains the openDBEntry for each path that currently has, or very recently had, at least
+	// one outstanding Open(). The map itself is protected by openDBEntriesMutex, but that mutex is only ever
+	// held long enough to look up or create an entry — never across the entry’s own, potentially slow, work.
+	openDBEntries      = map[string]*openDBEntry{}
+	openDBEntriesMutex = sync.Mutex{}
+)
+
+// getOpenDBEntry returns the openDBEntry for path, creating it if necessary.
+func getOpenDBEntry(path string) *openDBEntry {
+	openDBEntriesMutex.Lock()
+	defer openDBEntriesMutex.Unlock()
+	e, ok := openDBEntries[path]
+	if !ok {
+		e = &openDBEntry{}
+		openDBEntries[path] = e
+	}
+	return e
+}
+
+// openedDB returns the kept-open *bolt.DB for path, or nil if there isn’t one (i.e. Open() was never called,
+// or was called and failed, so the caller should fall back to opening/closing the database per call).
+// Unlike getOpenDBEntry, it never creates an entry, so per-call accesses don’t leave openDBEntries behind.
+func openedDB(path string) *bolt.DB {
+	openDBEntriesMutex.Lock()
+	e, ok := openDBEntries[path]
+	openDBEntriesMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.db
 }
 
 // New returns a BlobInfoCache implementation which uses a BoltDB file at path.
@@ -120,17 +190,99 @@ func new2(path string) *cache {
 	return &cache{path: path}
 }
 
+// NewWithMaxAge returns a BlobInfoCache implementation like New, except that it opportunistically prunes
+// knownLocations entries older than maxAge as part of ordinary RecordKnownLocation calls, so that long-running
+// processes (e.g. daemons) don’t accumulate references to blobs that have long since been garbage-collected at
+// the registry. A maxAge of zero disables opportunistic pruning, like New; use PruneOlderThan for an explicit,
+// unbounded sweep instead.
+func NewWithMaxAge(path string, maxAge time.Duration) types.BlobInfoCache {
+	return &cache{path: path, maxAge: maxAge}
+}
+
 // Open() sets up the cache for future accesses, potentially acquiring costly state. Each Open() must be paired with a Close().
 // Note that public callers may call the types.BlobInfoCache operations without Open()/Close().
+//
+// Open() keeps the underlying *bolt.DB handle open, refcounted per path, until the matching Close(); this lets a
+// caller making many Record* calls in a row (e.g. while copying a single image) pay the cost of opening and
+// locking the file only once. If the database can’t be opened here, Open() silently falls back to the
+// open/close-per-call behavior used when Open() was never called at all.
 func (bdc *cache) Open() {
+	for {
+		e := getOpenDBEntry(bdc.path)
+		e.mutex.Lock()
+		if e.closed {
+			// A concurrent Close() removed this entry from openDBEntries while we were waiting for its
+			// mutex (we fetched e just before that happened). It’s a dead end: resurrecting it would reuse
+			// a pathLock acquisition Close() already released. Drop it from openDBEntries if it is still
+			// there, then fetch (or create) the current entry for this path instead.
+			e.mutex.Unlock()
+			openDBEntriesMutex.Lock()
+			if cur, ok := openDBEntries[bdc.path]; ok && cur == e {
+				delete(openDBEntries, bdc.path)
+			}
+			openDBEntriesMutex.Unlock()
+			continue
+		}
+		defer e.mutex.Unlock()
+		if e.refCount > 0 {
+			e.refCount++
+			return
+		}
+		// Hold the path lock for the whole session, so that callers without an Open() session still exclude us
+		// the same way they would exclude each other. This, like bolt.Open below, can block for a while, but only
+		// e’s own mutex is held across it, not openDBEntriesMutex — so Open()/Close()/view()/update() on any other
+		// path proceed unimpeded.
+		lockPath(bdc.path)
+		db, err := bolt.Open(bdc.path, 0600, nil)
+		if err != nil {
+			unlockPath(bdc.path)
+			logrus.Debugf("Error opening %s for a long-lived blob info cache session, falling back to per-call access: %v", bdc.path, err)
+			return
+		}
+		e.db = db
+		e.refCount = 1
+		return
+	}
 }
 
 // Close destroys state created by Open().
 func (bdc *cache) Close() {
+	e := getOpenDBEntry(bdc.path)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.refCount == 0 {
+		return // Open() was either not called, or failed and fell back to per-call access.
+	}
+	e.refCount--
+	if e.refCount > 0 {
+		return
+	}
+	db := e.db
+	e.db = nil
+	if err := db.Close(); err != nil {
+		logrus.Debugf("Error closing long-lived blob info cache session for %s: %v", bdc.path, err)
+	}
+	unlockPath(bdc.path)
+
+	// Drop the now-unused entry, mirroring unlockPath above, so that a long-running process cycling through many
+	// distinct cache paths doesn’t retain one openDBEntry per path forever; a future Open() for this path just
+	// allocates a fresh one. Mark it closed (while e.mutex, held until this function returns, still excludes any
+	// Open() that fetched this same *e before the delete below) so such an Open() knows to retry instead of
+	// resurrecting an entry we’ve already removed from openDBEntries and whose pathLock we’ve already released.
+	e.closed = true
+	openDBEntriesMutex.Lock()
+	defer openDBEntriesMutex.Unlock()
+	if cur, ok := openDBEntries[bdc.path]; ok && cur == e {
+		delete(openDBEntries, bdc.path)
+	}
 }
 
 // view returns runs the specified fn within a read-only transaction on the database.
 func (bdc *cache) view(fn func(tx *bolt.Tx) error) (retErr error) {
+	if db := openedDB(bdc.path); db != nil {
+		return db.View(fn)
+	}
+
 	// bolt.Open(bdc.path, 0600, &bolt.Options{ReadOnly: true}) will, if the file does not exist,
 	// nevertheless create it, but with an O_RDONLY file descriptor, try to initialize it, and fail — while holding
 	// a read lock, blocking any future writes.
@@ -157,6 +309,10 @@ func (bdc *cache) view(fn func(tx *bolt.Tx) error) (retErr error) {
 
 // update returns runs the specified fn within a read-write transaction on the database.
 func (bdc *cache) update(fn func(tx *bolt.Tx) error) (retErr error) {
+	if db := openedDB(bdc.path); db != nil {
+		return db.Update(fn)
+	}
+
 	lockPath(bdc.path)
 	defer unlockPath(bdc.path)
 	db, err := bolt.Open(bdc.path, 0600, nil)
@@ -172,6 +328,39 @@ func (bdc *cache) update(fn func(tx *bolt.Tx) error) (retErr error) {
 	return db.Update(fn)
 }
 
+// BatchUpdate coalesces the Record* calls fn makes against the provided blobinfocache.BatchWriter into a single
+// underlying transaction, instead of the one-transaction-per-call cost each Record* method otherwise pays on its
+// own. Callers recording many digests for a single image (see copy/compression.go) should prefer this over
+// individual calls, especially when they are not already holding the cache open via Open().
+func (bdc *cache) BatchUpdate(fn func(blobinfocache.BatchWriter) error) error {
+	return bdc.update(func(tx *bolt.Tx) error {
+		return fn(&batchWriter{bdc: bdc, tx: tx})
+	})
+}
+
+// batchWriter implements blobinfocache.BatchWriter by running every Record* call against a single shared
+// transaction, instead of the individual bdc.update() call each Record* method uses outside of a batch.
+type batchWriter struct {
+	bdc *cache
+	tx  *bolt.Tx
+}
+
+func (bw *batchWriter) RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
+	_ = bw.bdc.recordDigestUncompressedPair(bw.tx, anyDigest, uncompressed) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
+
+func (bw *batchWriter) RecordTOCUncompressedPair(tocDigest digest.Digest, uncompressed digest.Digest) {
+	_ = bw.bdc.recordTOCUncompressedPair(bw.tx, tocDigest, uncompressed) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
+
+func (bw *batchWriter) RecordDigestCompressorData(anyDigest digest.Digest, data blobinfocache.DigestCompressorData) {
+	_ = bw.bdc.recordDigestCompressorData(bw.tx, anyDigest, data) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
+
+func (bw *batchWriter) RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) {
+	_ = bw.bdc.recordKnownLocation(bw.tx, transport, scope, blobDigest, location) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
+
 // uncompressedDigest implements BlobInfoCache.UncompressedDigest within the provided read-only transaction.
 func (bdc *cache) uncompressedDigest(tx *bolt.Tx, anyDigest digest.Digest) digest.Digest {
 	if b := tx.Bucket(uncompressedDigestBucket); b != nil {
@@ -197,6 +386,35 @@ func (bdc *cache) uncompressedDigest(tx *bolt.Tx, anyDigest digest.Digest) diges
 	return ""
 }
 
+// recordKnownDigest records the current time for anyDigest in knownDigestsBucket, so that it can later be
+// suggested as a cross-registry reuse candidate (while still recent) even in scopes that never recorded a
+// location for it directly.
+func recordKnownDigest(tx *bolt.Tx, anyDigest digest.Digest) error {
+	return recordKnownDigestAt(tx, anyDigest, time.Now())
+}
+
+// recordKnownDigestAt is like recordKnownDigest, but records at instead of the current time; it keeps the newer
+// of at and any existing entry, so it is safe to call with a timestamp taken from previously-recorded data (e.g.
+// while importing an export, where at should be the original observation’s own time, not the time of the import).
+func recordKnownDigestAt(tx *bolt.Tx, anyDigest digest.Digest, at time.Time) error {
+	b, err := tx.CreateBucketIfNotExists(knownDigestsBucket)
+	if err != nil {
+		return err
+	}
+	key := []byte(anyDigest.String())
+	if existing := b.Get(key); existing != nil {
+		var t time.Time
+		if err := t.UnmarshalBinary(existing); err == nil && !t.Before(at) {
+			return nil // The existing entry is already at least as new; nothing to do.
+		}
+	}
+	value, err := at.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
 // UncompressedDigest returns an uncompressed digest corresponding to anyDigest.
 // May return anyDigest if it is known to be uncompressed.
 // Returns "" if nothing is known about the digest (it may be compressed or uncompressed).
@@ -218,37 +436,43 @@ func (bdc *cache) UncompressedDigest(anyDigest digest.Digest) digest.Digest {
 // (Eventually, the DiffIDs in image config could detect the substitution, but that may be too late, and not all image formats contain that data.)
 func (bdc *cache) RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
 	_ = bdc.update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(uncompressedDigestBucket)
-		if err != nil {
-			return err
-		}
-		key := []byte(anyDigest.String())
-		if previousBytes := b.Get(key); previousBytes != nil {
-			previous, err := digest.Parse(string(previousBytes))
-			if err != nil {
-				return err
-			}
-			if previous != uncompressed {
-				logrus.Warnf("Uncompressed digest for blob %s previously recorded as %s, now %s", anyDigest, previous, uncompressed)
-			}
-		}
-		if err := b.Put(key, []byte(uncompressed.String())); err != nil {
-			return err
-		}
+		return bdc.recordDigestUncompressedPair(tx, anyDigest, uncompressed)
+	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
 
-		b, err = tx.CreateBucketIfNotExists(digestByUncompressedBucket)
-		if err != nil {
-			return err
-		}
-		b, err = b.CreateBucketIfNotExists([]byte(uncompressed.String()))
+// recordDigestUncompressedPair implements RecordDigestUncompressedPair within the provided read-write transaction,
+// so that it can also be used from BatchUpdate.
+func (bdc *cache) recordDigestUncompressedPair(tx *bolt.Tx, anyDigest digest.Digest, uncompressed digest.Digest) error {
+	b, err := tx.CreateBucketIfNotExists(uncompressedDigestBucket)
+	if err != nil {
+		return err
+	}
+	key := []byte(anyDigest.String())
+	if previousBytes := b.Get(key); previousBytes != nil {
+		previous, err := digest.Parse(string(previousBytes))
 		if err != nil {
 			return err
 		}
-		if err := b.Put([]byte(anyDigest.String()), []byte{}); err != nil { // Possibly writing the same []byte{} presence marker again.
-			return err
+		if previous != uncompressed {
+			logrus.Warnf("Uncompressed digest for blob %s previously recorded as %s, now %s", anyDigest, previous, uncompressed)
 		}
-		return nil
-	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+	}
+	if err := b.Put(key, []byte(uncompressed.String())); err != nil {
+		return err
+	}
+
+	b, err = tx.CreateBucketIfNotExists(digestByUncompressedBucket)
+	if err != nil {
+		return err
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(uncompressed.String()))
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(anyDigest.String()), []byte{}); err != nil { // Possibly writing the same []byte{} presence marker again.
+		return err
+	}
+	return nil
 }
 
 // UncompressedDigestForTOC returns an uncompressed digest corresponding to anyDigest.
@@ -280,25 +504,116 @@ func (bdc *cache) UncompressedDigestForTOC(tocDigest digest.Digest) digest.Diges
 // (Eventually, the DiffIDs in image config could detect the substitution, but that may be too late, and not all image formats contain that data.)
 func (bdc *cache) RecordTOCUncompressedPair(tocDigest digest.Digest, uncompressed digest.Digest) {
 	_ = bdc.update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(uncompressedDigestByTOCBucket)
+		return bdc.recordTOCUncompressedPair(tx, tocDigest, uncompressed)
+	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
+
+// recordTOCUncompressedPair implements RecordTOCUncompressedPair within the provided read-write transaction,
+// so that it can also be used from BatchUpdate and LookupOrRecordTOC.
+func (bdc *cache) recordTOCUncompressedPair(tx *bolt.Tx, tocDigest digest.Digest, uncompressed digest.Digest) error {
+	b, err := tx.CreateBucketIfNotExists(uncompressedDigestByTOCBucket)
+	if err != nil {
+		return err
+	}
+	key := []byte(tocDigest.String())
+	if previousBytes := b.Get(key); previousBytes != nil {
+		previous, err := digest.Parse(string(previousBytes))
 		if err != nil {
 			return err
 		}
-		key := []byte(tocDigest.String())
-		if previousBytes := b.Get(key); previousBytes != nil {
-			previous, err := digest.Parse(string(previousBytes))
-			if err != nil {
-				return err
-			}
-			if previous != uncompressed {
-				logrus.Warnf("Uncompressed digest for blob with TOC %q previously recorded as %q, now %q", tocDigest, previous, uncompressed)
-			}
+		if previous != uncompressed {
+			logrus.Warnf("Uncompressed digest for blob with TOC %q previously recorded as %q, now %q", tocDigest, previous, uncompressed)
 		}
-		if err := b.Put(key, []byte(uncompressed.String())); err != nil {
-			return err
+	}
+	if err := b.Put(key, []byte(uncompressed.String())); err != nil {
+		return err
+	}
+	return nil
+}
+
+// tocComputation tracks an in-progress LookupOrRecordTOC computeFn call for a single (cache path, TOC digest)
+// pair, so that concurrent callers resolving the same TOC (e.g. concurrent zstd:chunked partial pulls of the same
+// layer) share one computation instead of redundantly running it, without holding a database transaction (and
+// hence, like every other transaction in this file, the whole file's pathLock) for however long an arbitrary,
+// caller-supplied decompression/digest computation takes.
+type tocComputation struct {
+	done   chan struct{} // Closed once result/err are set.
+	result digest.Digest
+	err    error
+}
+
+var (
+	// tocComputations contains an entry for every (path, TOC digest) pair with a computeFn currently running
+	// somewhere in this process. The map is protected by tocComputationsMutex, held only long enough to look up,
+	// insert, or remove an entry — never across the computation itself.
+	tocComputations      = map[string]*tocComputation{}
+	tocComputationsMutex = sync.Mutex{}
+)
+
+// LookupOrRecordTOC returns the uncompressed digest already recorded for tocDigest, if any; otherwise it calls
+// computeFn to compute it, records the result exactly as RecordTOCUncompressedPair would (including the "warn on
+// mismatch, keep newest" behavior, though a mismatch should not be reachable through this path), and returns it.
+// computeFn runs outside of any database transaction, so a slow computation (e.g. validating a whole partially-
+// pulled zstd:chunked layer) does not block unrelated cache accesses for the duration; instead, concurrent callers
+// for the same (cache path, tocDigest) share a single in-flight computeFn call via tocComputations, so that only
+// one of them actually invokes computeFn and the rest just reuse its result.
+func (bdc *cache) LookupOrRecordTOC(tocDigest digest.Digest, computeFn func() (digest.Digest, error)) (digest.Digest, error) {
+	if d, ok := bdc.lookupTOC(tocDigest); ok {
+		return d, nil
+	}
+
+	key := bdc.path + "\x00" + tocDigest.String()
+	tocComputationsMutex.Lock()
+	if c, ok := tocComputations[key]; ok {
+		tocComputationsMutex.Unlock()
+		<-c.done
+		return c.result, c.err
+	}
+	c := &tocComputation{done: make(chan struct{})}
+	tocComputations[key] = c
+	tocComputationsMutex.Unlock()
+
+	// Look up again now that this call owns the computation: a previous owner may have recorded the result and
+	// removed its tocComputations entry between the lookup above and the insertion of c.
+	var err error
+	computed, found := bdc.lookupTOC(tocDigest)
+	if !found {
+		computed, err = computeFn()
+		if err == nil {
+			err = bdc.update(func(tx *bolt.Tx) error {
+				return bdc.recordTOCUncompressedPair(tx, tocDigest, computed)
+			})
+		}
+	}
+	if err == nil {
+		c.result = computed
+	} else {
+		c.err = err
+	}
+
+	tocComputationsMutex.Lock()
+	delete(tocComputations, key)
+	tocComputationsMutex.Unlock()
+	close(c.done)
+
+	return c.result, c.err
+}
+
+// lookupTOC returns the uncompressed digest already recorded for tocDigest, and true, if one is present;
+// it returns ok == false if nothing is recorded yet (including if the cache can't currently be read at all).
+func (bdc *cache) lookupTOC(tocDigest digest.Digest) (res digest.Digest, ok bool) {
+	_ = bdc.view(func(tx *bolt.Tx) error { // Including os.IsNotExist(err): no database yet means nothing is recorded.
+		if b := tx.Bucket(uncompressedDigestByTOCBucket); b != nil {
+			if previousBytes := b.Get([]byte(tocDigest.String())); previousBytes != nil {
+				if d, err := digest.Parse(string(previousBytes)); err == nil {
+					res, ok = d, true
+				}
+				// FIXME? Log err (but throttle the log volume on repeated accesses)?
+			}
 		}
 		return nil
-	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+	})
+	return res, ok
 }
 
 // RecordDigestCompressorData records data for the blob with the specified digest.
@@ -313,92 +628,329 @@ func (bdc *cache) RecordTOCUncompressedPair(tocDigest digest.Digest, uncompresse
 // information in a manifest.
 func (bdc *cache) RecordDigestCompressorData(anyDigest digest.Digest, data blobinfocache.DigestCompressorData) {
 	_ = bdc.update(func(tx *bolt.Tx) error {
-		key := []byte(anyDigest.String())
+		return bdc.recordDigestCompressorData(tx, anyDigest, data)
+	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
 
-		b, err := tx.CreateBucketIfNotExists(digestCompressorBucket)
-		if err != nil {
-			return err
+// recordDigestCompressorData implements RecordDigestCompressorData within the provided read-write transaction,
+// so that it can also be used from BatchUpdate.
+func (bdc *cache) recordDigestCompressorData(tx *bolt.Tx, anyDigest digest.Digest, data blobinfocache.DigestCompressorData) error {
+	key := []byte(anyDigest.String())
+
+	b, err := tx.CreateBucketIfNotExists(digestCompressorBucket)
+	if err != nil {
+		return err
+	}
+	warned := false
+	if previousBytes := b.Get(key); previousBytes != nil {
+		if string(previousBytes) != data.BaseVariantCompressor {
+			logrus.Warnf("Compressor for blob with digest %s previously recorded as %s, now %s", anyDigest, string(previousBytes), data.BaseVariantCompressor)
+			warned = true
 		}
-		warned := false
-		if previousBytes := b.Get(key); previousBytes != nil {
-			if string(previousBytes) != data.BaseVariantCompressor {
-				logrus.Warnf("Compressor for blob with digest %s previously recorded as %s, now %s", anyDigest, string(previousBytes), data.BaseVariantCompressor)
-				warned = true
-			}
+	}
+	if data.BaseVariantCompressor == blobinfocache.UnknownCompression {
+		if err := b.Delete(key); err != nil {
+			return err
 		}
-		if data.BaseVariantCompressor == blobinfocache.UnknownCompression {
+		if b := tx.Bucket(digestSpecificVariantCompressorBucket); b != nil {
 			if err := b.Delete(key); err != nil {
 				return err
 			}
-			if b := tx.Bucket(digestSpecificVariantCompressorBucket); b != nil {
-				if err := b.Delete(key); err != nil {
-					return err
-				}
-			}
 		}
-		if err := b.Put(key, []byte(data.BaseVariantCompressor)); err != nil {
+	}
+	if err := b.Put(key, []byte(data.BaseVariantCompressor)); err != nil {
+		return err
+	}
+
+	if data.SpecificVariantCompressor != blobinfocache.UnknownCompression {
+		b, err := tx.CreateBucketIfNotExists(digestSpecificVariantCompressorBucket)
+		if err != nil {
 			return err
 		}
-
-		if data.SpecificVariantCompressor != blobinfocache.UnknownCompression {
-			b, err := tx.CreateBucketIfNotExists(digestSpecificVariantCompressorBucket)
-			if err != nil {
-				return err
-			}
-			if !warned { // Don’t warn twice about the same digest
-				if previousBytes := b.Get(key); previousBytes != nil {
-					if prevSVCBytes, _, ok := bytes.Cut(previousBytes, []byte{0}); ok {
-						prevSVC := string(prevSVCBytes)
-						if data.SpecificVariantCompressor != prevSVC {
-							logrus.Warnf("Specific compressor for blob with digest %s previously recorded as %s, now %s", anyDigest, prevSVC, data.SpecificVariantCompressor)
-						}
+		if !warned { // Don’t warn twice about the same digest
+			if previousBytes := b.Get(key); previousBytes != nil {
+				if prevSVCBytes, _, ok := bytes.Cut(previousBytes, []byte{0}); ok {
+					prevSVC := string(prevSVCBytes)
+					if data.SpecificVariantCompressor != prevSVC {
+						logrus.Warnf("Specific compressor for blob with digest %s previously recorded as %s, now %s", anyDigest, prevSVC, data.SpecificVariantCompressor)
 					}
 				}
 			}
-			annotations, err := json.Marshal(data.SpecificVariantAnnotations)
-			if err != nil {
-				return err
-			}
-			data := bytes.Clone([]byte(data.SpecificVariantCompressor))
-			data = append(data, 0)
-			data = append(data, annotations...)
-			if err := b.Put(key, data); err != nil {
-				return err
-			}
 		}
-		return nil
-	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+		annotations, err := json.Marshal(data.SpecificVariantAnnotations)
+		if err != nil {
+			return err
+		}
+		data := bytes.Clone([]byte(data.SpecificVariantCompressor))
+		data = append(data, 0)
+		data = append(data, annotations...)
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+	}
+	return recordKnownDigest(tx, anyDigest)
 }
 
 // RecordKnownLocation records that a blob with the specified digest exists within the specified (transport, scope) scope,
 // and can be reused given the opaque location data.
 func (bdc *cache) RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) {
 	_ = bdc.update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(knownLocationsBucket)
-		if err != nil {
+		return bdc.recordKnownLocation(tx, transport, scope, blobDigest, location)
+	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+}
+
+// recordKnownLocation implements RecordKnownLocation within the provided read-write transaction, so that it can
+// also be used from BatchUpdate.
+func (bdc *cache) recordKnownLocation(tx *bolt.Tx, transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) error {
+	b, err := tx.CreateBucketIfNotExists(knownLocationsBucket)
+	if err != nil {
+		return err
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(transport.Name()))
+	if err != nil {
+		return err
+	}
+	scopeBucket, err := b.CreateBucketIfNotExists([]byte(scope.Opaque))
+	if err != nil {
+		return err
+	}
+	b, err = scopeBucket.CreateBucketIfNotExists([]byte(blobDigest.String()))
+	if err != nil {
+		return err
+	}
+	value, err := time.Now().MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(location.Opaque), value); err != nil { // Possibly overwriting an older entry.
+		return err
+	}
+	if bdc.maxAge > 0 {
+		cutoff := time.Now().Add(-bdc.maxAge)
+		if _, err := pruneLocationsOlderThan(scopeBucket, cutoff, opportunisticPruneBudget, true); err != nil {
 			return err
 		}
-		b, err = b.CreateBucketIfNotExists([]byte(transport.Name()))
+		knownDigests, err := tx.CreateBucketIfNotExists(knownDigestsBucket)
 		if err != nil {
 			return err
 		}
-		b, err = b.CreateBucketIfNotExists([]byte(scope.Opaque))
-		if err != nil {
+		if _, err := pruneStaleMarkers(knownDigests, cutoff, opportunisticPruneBudget, true); err != nil {
 			return err
 		}
-		b, err = b.CreateBucketIfNotExists([]byte(blobDigest.String()))
-		if err != nil {
-			return err
+	}
+	return recordKnownDigest(tx, blobDigest)
+}
+
+// opportunisticPruneBudget bounds the number of knownLocations leaf (location) entries inspected by a single
+// opportunistic prune triggered from recordKnownLocation, so that an ordinary Record call doesn’t turn into an
+// unbounded sweep of a scope that has accumulated a lot of history.
+const opportunisticPruneBudget = 64
+
+// bucketIsEmpty returns true if b contains no entries at all.
+func bucketIsEmpty(b *bolt.Bucket) bool {
+	k, _ := b.Cursor().First()
+	return k == nil
+}
+
+// cursorNextKeyBounded advances c (freshly positioned at first/k0,v0) collecting up to budget keys for which
+// include(k, v) is true, starting at startKey (or the beginning, if startKey is nil) and wrapping around to the
+// beginning at most once if it reaches the end before startKey is reached again. It returns the collected keys
+// (cloned, so they remain valid after further cursor movement) and the key to resume at next time (nil if the
+// whole bucket was covered, i.e. the next resumable call should start over from the beginning).
+func cursorNextKeyBounded(c *bolt.Cursor, startKey []byte, budget int, include func(k, v []byte) bool) ([][]byte, []byte) {
+	var k, v []byte
+	if startKey != nil {
+		k, v = c.Seek(startKey)
+	} else {
+		k, v = c.First()
+	}
+	wrapped := startKey == nil
+	var keys [][]byte
+	inspected := 0
+	for inspected < budget {
+		if k == nil {
+			if wrapped {
+				break
+			}
+			wrapped = true
+			k, v = c.First()
+			continue
 		}
-		value, err := time.Now().MarshalBinary()
-		if err != nil {
-			return err
+		if wrapped && startKey != nil && bytes.Compare(k, startKey) >= 0 {
+			k = nil // Back at startKey: the whole bucket has been covered.
+			break
 		}
-		if err := b.Put([]byte(location.Opaque), value); err != nil { // Possibly overwriting an older entry.
-			return err
+		if !bytes.Equal(k, pruneCursorKey) {
+			inspected++
+			if include(k, v) {
+				keys = append(keys, bytes.Clone(k))
+			}
+		}
+		k, v = c.Next()
+	}
+	var next []byte
+	if k != nil {
+		next = bytes.Clone(k)
+	}
+	return keys, next
+}
+
+// saveResumeCursor persists next, the resume point returned by cursorNextKeyBounded, in b as pruneCursorKey (or
+// removes it, if next is nil, so that the following resumable call starts over from the beginning).
+func saveResumeCursor(b *bolt.Bucket, next []byte) error {
+	if next != nil {
+		return b.Put(pruneCursorKey, next)
+	}
+	return b.Delete(pruneCursorKey)
+}
+
+// pruneLocationsOlderThan deletes knownLocations leaf entries (location -> time) in scopeBucket (a bucket keyed
+// by blob digest, each containing a bucket keyed by location) whose recorded time is before cutoff, removing
+// digest buckets that become empty as a result. It inspects at most budget digest buckets (and, across all of
+// them, at most budget leaf entries), to bound the work done within a single transaction, and returns the number
+// of leaf entries it removed.
+//
+// If resume is true, the scan starts after the digest key a previous resume=true call left off at (persisted in
+// scopeBucket itself via pruneCursorKey), and wraps back to the beginning once it reaches the end; this is what
+// lets repeated bounded calls (the opportunistic pruning in recordKnownLocation) eventually reach every digest in
+// a scope that has accumulated more of them than fit in one budget, instead of re-examining the same
+// head-of-cursor entries forever. Callers doing a single unbounded sweep (budget == math.MaxInt, as PruneOlderThan
+// does) should pass resume=false: such a sweep already covers the whole bucket in one call and has no use for,
+// and shouldn't perturb, the resume position used by opportunistic pruning.
+//
+// Deletions are collected in a first pass and applied in a second, rather than mutating while a cursor is still
+// traversing the same bucket, per BoltDB’s documented cursor-invalidation caveats.
+func pruneLocationsOlderThan(scopeBucket *bolt.Bucket, cutoff time.Time, budget int, resume bool) (int, error) {
+	var startKey []byte
+	if resume {
+		startKey = scopeBucket.Get(pruneCursorKey)
+	}
+	digestKeys, next := cursorNextKeyBounded(scopeBucket.Cursor(), startKey, budget, func(_, dv []byte) bool {
+		return dv == nil // A sub-bucket, as opposed to some unexpected leaf value directly in scopeBucket.
+	})
+
+	removed := 0
+	inspected := 0
+	for _, dk := range digestKeys {
+		digestBucket := scopeBucket.Bucket(dk)
+		if digestBucket == nil {
+			continue
+		}
+		var staleLocations [][]byte
+		lc := digestBucket.Cursor()
+		for lk, lv := lc.First(); lk != nil && inspected < budget; lk, lv = lc.Next() {
+			inspected++
+			var t time.Time
+			if err := t.UnmarshalBinary(lv); err != nil {
+				continue // Leave unparseable entries alone rather than risk deleting live data.
+			}
+			if t.Before(cutoff) {
+				staleLocations = append(staleLocations, bytes.Clone(lk))
+			}
+		}
+		for _, lk := range staleLocations {
+			if err := digestBucket.Delete(lk); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+		if bucketIsEmpty(digestBucket) {
+			if err := scopeBucket.DeleteBucket(dk); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	if resume {
+		if err := saveResumeCursor(scopeBucket, next); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// pruneStaleMarkers deletes leaf entries in b (a flat bucket mapping a key directly to a BinaryMarshaller-encoded
+// time.Time, such as knownDigestsBucket) whose recorded time is before cutoff. It behaves exactly like
+// pruneLocationsOlderThan, including its bounded-budget, resumable-cursor behavior (see there for details) —
+// except that b has no nested per-key buckets to descend into, so every non-marker entry directly in b is a
+// candidate for pruning.
+func pruneStaleMarkers(b *bolt.Bucket, cutoff time.Time, budget int, resume bool) (int, error) {
+	var startKey []byte
+	if resume {
+		startKey = b.Get(pruneCursorKey)
+	}
+	staleKeys, next := cursorNextKeyBounded(b.Cursor(), startKey, budget, func(_, v []byte) bool {
+		var t time.Time
+		return t.UnmarshalBinary(v) == nil && t.Before(cutoff) // Leave unparseable entries alone rather than risk deleting live data.
+	})
+
+	removed := 0
+	for _, k := range staleKeys {
+		if err := b.Delete(k); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	if resume {
+		if err := saveResumeCursor(b, next); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// PruneOlderThan removes all knownLocations entries recorded more than d ago, across every transport and scope,
+// deleting scope and transport buckets that become empty as a result; it also removes knownDigestsBucket entries
+// older than d. Removing knownDigestsBucket entries does not change which candidates CandidateLocations2 returns
+// (see appendReplacementCandidates). Unlike the opportunistic pruning enabled by
+// NewWithMaxAge, this inspects the whole cache in one unbounded sweep, and is intended to be run out-of-band,
+// e.g. from an explicit maintenance command.
+func (bdc *cache) PruneOlderThan(d time.Duration) error {
+	cutoff := time.Now().Add(-d)
+	return bdc.update(func(tx *bolt.Tx) error {
+		if top := tx.Bucket(knownLocationsBucket); top != nil {
+			var transportKeys [][]byte
+			tc := top.Cursor()
+			for tk, tv := tc.First(); tk != nil; tk, tv = tc.Next() {
+				if tv == nil {
+					transportKeys = append(transportKeys, bytes.Clone(tk))
+				}
+			}
+			for _, tk := range transportKeys {
+				transportBucket := top.Bucket(tk)
+				var scopeKeys [][]byte
+				sc := transportBucket.Cursor()
+				for sk, sv := sc.First(); sk != nil; sk, sv = sc.Next() {
+					if sv == nil {
+						scopeKeys = append(scopeKeys, bytes.Clone(sk))
+					}
+				}
+				for _, sk := range scopeKeys {
+					scopeBucket := transportBucket.Bucket(sk)
+					if _, err := pruneLocationsOlderThan(scopeBucket, cutoff, math.MaxInt, false); err != nil {
+						return err
+					}
+					if bucketIsEmpty(scopeBucket) {
+						if err := transportBucket.DeleteBucket(sk); err != nil {
+							return err
+						}
+					}
+				}
+				if bucketIsEmpty(transportBucket) {
+					if err := top.DeleteBucket(tk); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if knownDigests := tx.Bucket(knownDigestsBucket); knownDigests != nil {
+			if _, err := pruneStaleMarkers(knownDigests, cutoff, math.MaxInt, false); err != nil {
+				return err
+			}
 		}
 		return nil
-	}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
+	})
 }
 
 // appendReplacementCandidates creates prioritize.CandidateWithTime values for digest in scopeBucket
@@ -407,7 +959,11 @@ func (bdc *cache) RecordKnownLocation(transport types.ImageTransport, scope type
 // to candidates.
 // v2Options is not nil if the caller is CandidateLocations2: this allows including candidates with unknown location, and filters out candidates
 // with unknown compression.
-func (bdc *cache) appendReplacementCandidates(candidates []prioritize.CandidateWithTime, scopeBucket, compressionBucket, specificVariantCompresssionBucket *bolt.Bucket,
+// knownDigestsBucket (which might be nil) is the global index of every digest this cache has recorded (and not yet pruned). It is
+// checked only when there is no scope-local location; by then, with v2Options, a digest with unknown compression has already been
+// filtered out, and a digest with known compression is suggested with an unknown location regardless of knownDigestsBucket. So its
+// contents do not change which candidates are returned.
+func (bdc *cache) appendReplacementCandidates(candidates []prioritize.CandidateWithTime, scopeBucket, compressionBucket, specificVariantCompresssionBucket, knownDigestsBucket *bolt.Bucket,
 	digest digest.Digest, v2Options *blobinfocache.CandidateLocations2Options) []prioritize.CandidateWithTime {
 	digestKey := []byte(digest.String())
 	compressionData := blobinfocache.DigestCompressorData{
@@ -451,7 +1007,14 @@ func (bdc *cache) appendReplacementCandidates(candidates []prioritize.CandidateW
 			return nil
 		}) // FIXME? Log error (but throttle the log volume on repeated accesses)?
 	} else if v2Options != nil {
-		candidates = append(candidates, template.CandidateWithUnknownLocation())
+		knownCompression := compressionData.BaseVariantCompressor != blobinfocache.UnknownCompression
+		knownElsewhereRecently := knownDigestsBucket != nil && knownDigestsBucket.Get(digestKey) != nil
+		if knownCompression || knownElsewhereRecently {
+			// No location is known in this (transport, scope). Suggest the digest with an unknown location, so that
+			// callers like docker.dockerImageDestination.TryReusingBlob can attempt a cross-repository mount.
+			// template != nil above implies the compression is known, so knownCompression is always true here.
+			candidates = append(candidates, template.CandidateWithUnknownLocation())
+		}
 	}
 	return candidates
 }
@@ -481,8 +1044,9 @@ func (bdc *cache) candidateLocations(transport types.ImageTransport, scope types
 		// and we don't want to fail just because of that
 		compressionBucket := tx.Bucket(digestCompressorBucket)
 		specificVariantCompressionBucket := tx.Bucket(digestSpecificVariantCompressorBucket)
+		knownDigests := tx.Bucket(knownDigestsBucket)
 
-		res = bdc.appendReplacementCandidates(res, scopeBucket, compressionBucket, specificVariantCompressionBucket, primaryDigest, v2Options)
+		res = bdc.appendReplacementCandidates(res, scopeBucket, compressionBucket, specificVariantCompressionBucket, knownDigests, primaryDigest, v2Options)
 		if canSubstitute {
 			if uncompressedDigestValue = bdc.uncompressedDigest(tx, primaryDigest); uncompressedDigestValue != "" {
 				b := tx.Bucket(digestByUncompressedBucket)
@@ -495,7 +1059,7 @@ func (bdc *cache) candidateLocations(transport types.ImageTransport, scope types
 								return err
 							}
 							if d != primaryDigest && d != uncompressedDigestValue {
-								res = bdc.appendReplacementCandidates(res, scopeBucket, compressionBucket, specificVariantCompressionBucket, d, v2Options)
+								res = bdc.appendReplacementCandidates(res, scopeBucket, compressionBucket, specificVariantCompressionBucket, knownDigests, d, v2Options)
 							}
 							return nil
 						}); err != nil {
@@ -504,7 +1068,7 @@ func (bdc *cache) candidateLocations(transport types.ImageTransport, scope types
 					}
 				}
 				if uncompressedDigestValue != primaryDigest {
-					res = bdc.appendReplacementCandidates(res, scopeBucket, compressionBucket, specificVariantCompressionBucket, uncompressedDigestValue, v2Options)
+					res = bdc.appendReplacementCandidates(res, scopeBucket, compressionBucket, specificVariantCompressionBucket, knownDigests, uncompressedDigestValue, v2Options)
 				}
 			}
 		}
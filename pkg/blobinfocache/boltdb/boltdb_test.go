@@ -0,0 +1,529 @@
+package boltdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/internal/blobinfocache"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// fakeTransport is a minimal types.ImageTransport good enough to exercise the (transport, scope)-keyed
+// parts of the cache; nothing in this package calls anything beyond Name().
+type fakeTransport string
+
+func (t fakeTransport) Name() string { return string(t) }
+func (t fakeTransport) ParseReference(reference string) (types.ImageReference, error) {
+	panic("unused")
+}
+func (t fakeTransport) ValidatePolicyConfigurationScope(scope string) error { panic("unused") }
+
+func newTestCache(t *testing.T) *cache {
+	return new2(filepath.Join(t.TempDir(), "cache.db"))
+}
+
+// testDigest returns a distinct, valid sha256 digest.Digest for n, for use as test fixture data.
+func testDigest(n int) digest.Digest {
+	return digest.FromString(fmt.Sprintf("test digest #%d", n))
+}
+
+func TestCandidateLocations2CrossRegistryFallback(t *testing.T) {
+	digestA := testDigest(0)
+	transport := fakeTransport("docker")
+	scopeA := types.BICTransportScope{Opaque: "registry.example/repoA"}
+	scopeB := types.BICTransportScope{Opaque: "registry.example/repoB"}
+
+	bdc := newTestCache(t)
+	bdc.RecordDigestCompressorData(digestA, blobinfocache.DigestCompressorData{
+		BaseVariantCompressor: blobinfocache.Gzip,
+	})
+	bdc.RecordKnownLocation(transport, scopeA, digestA, types.BICLocationReference{Opaque: "locationA"})
+
+	// scopeB never recorded a location for digestA, but the cache knows about digestA (via scopeA); it
+	// should still be suggested as a lower-priority, unknown-location cross-registry candidate.
+	candidates := bdc.CandidateLocations2(transport, scopeB, digestA, blobinfocache.CandidateLocations2Options{})
+	require.Len(t, candidates, 1)
+	assert.Equal(t, digestA, candidates[0].Digest)
+	assert.True(t, candidates[0].UnknownLocation)
+}
+
+func TestCandidateLocations2ScopeLocalBeatsCrossRegistry(t *testing.T) {
+	digestA := testDigest(1)
+	transport := fakeTransport("docker")
+	scopeA := types.BICTransportScope{Opaque: "registry.example/repoA"}
+	scopeB := types.BICTransportScope{Opaque: "registry.example/repoB"}
+
+	bdc := newTestCache(t)
+	bdc.RecordDigestCompressorData(digestA, blobinfocache.DigestCompressorData{
+		BaseVariantCompressor: blobinfocache.Gzip,
+	})
+	bdc.RecordKnownLocation(transport, scopeA, digestA, types.BICLocationReference{Opaque: "locationA"})
+	bdc.RecordKnownLocation(transport, scopeB, digestA, types.BICLocationReference{Opaque: "locationB"})
+
+	candidates := bdc.CandidateLocations2(transport, scopeB, digestA, blobinfocache.CandidateLocations2Options{})
+	require.Len(t, candidates, 1)
+	assert.False(t, candidates[0].UnknownLocation)
+	assert.Equal(t, types.BICLocationReference{Opaque: "locationB"}, candidates[0].Location)
+}
+
+func TestCandidateLocations2NeverRecordedDigest(t *testing.T) {
+	digestA := testDigest(2)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+
+	bdc := newTestCache(t)
+	// Nothing was ever recorded for digestA anywhere; the cache must not fabricate a candidate for it.
+	candidates := bdc.CandidateLocations2(transport, scope, digestA, blobinfocache.CandidateLocations2Options{})
+	assert.Empty(t, candidates)
+}
+
+func TestOpenCloseSession(t *testing.T) {
+	digestA := testDigest(3)
+	uncompressedA := testDigest(4)
+
+	bdc := newTestCache(t)
+
+	// Nested Open()/Close() pairs, as a caller coordinating several sub-operations over the same cache might do,
+	// must share a single kept-open database and only release it on the last matching Close().
+	bdc.Open()
+	bdc.Open()
+	bdc.RecordDigestUncompressedPair(digestA, uncompressedA)
+	assert.Equal(t, uncompressedA, bdc.UncompressedDigest(digestA))
+	bdc.Close()
+	// Still open once: the cache must remain usable.
+	assert.Equal(t, uncompressedA, bdc.UncompressedDigest(digestA))
+	bdc.Close()
+
+	// After the last Close(), the cache must fall back to per-call access and still work correctly.
+	assert.Equal(t, uncompressedA, bdc.UncompressedDigest(digestA))
+
+	// The last Close() must also drop the per-path bookkeeping entry, so that a long-running process cycling
+	// through many distinct cache paths doesn’t retain one forever.
+	openDBEntriesMutex.Lock()
+	_, stillTracked := openDBEntries[bdc.path]
+	openDBEntriesMutex.Unlock()
+	assert.False(t, stillTracked)
+}
+
+// TestOpenSkipsClosedEntry is a regression test for Open() resurrecting an openDBEntry a concurrent Close() had
+// already torn down and removed from openDBEntries: if Open() found such an entry (because it fetched it from the
+// map just before the racing Close() deleted it) and just reused it, it would reopen a *bolt.DB and re-acquire
+// the pathLock without either ever being released again, wedging every future access to the path.
+func TestOpenSkipsClosedEntry(t *testing.T) {
+	digestA := testDigest(27)
+	uncompressedA := testDigest(28)
+
+	bdc := newTestCache(t)
+
+	// Simulate the race window: a *openDBEntry already marked closed by Close(), but still reachable because
+	// some other goroutine fetched it (and is blocked on its mutex) before Close() deleted it from the map.
+	stale := &openDBEntry{closed: true}
+	openDBEntriesMutex.Lock()
+	openDBEntries[bdc.path] = stale
+	openDBEntriesMutex.Unlock()
+
+	bdc.Open()
+	defer bdc.Close()
+
+	openDBEntriesMutex.Lock()
+	current := openDBEntries[bdc.path]
+	openDBEntriesMutex.Unlock()
+	assert.NotSame(t, stale, current, "Open() must not resurrect a closed entry")
+
+	bdc.RecordDigestUncompressedPair(digestA, uncompressedA)
+	assert.Equal(t, uncompressedA, bdc.UncompressedDigest(digestA))
+}
+
+func TestBatchUpdate(t *testing.T) {
+	digestA := testDigest(5)
+	uncompressedA := testDigest(6)
+	tocA := testDigest(7)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+
+	bdc := newTestCache(t)
+	err := bdc.BatchUpdate(func(bw blobinfocache.BatchWriter) error {
+		bw.RecordDigestUncompressedPair(digestA, uncompressedA)
+		bw.RecordTOCUncompressedPair(tocA, uncompressedA)
+		bw.RecordDigestCompressorData(digestA, blobinfocache.DigestCompressorData{
+			BaseVariantCompressor: blobinfocache.Gzip,
+		})
+		bw.RecordKnownLocation(transport, scope, digestA, types.BICLocationReference{Opaque: "locationA"})
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, uncompressedA, bdc.UncompressedDigest(digestA))
+	assert.Equal(t, uncompressedA, bdc.UncompressedDigestForTOC(tocA))
+	candidates := bdc.CandidateLocations2(transport, scope, digestA, blobinfocache.CandidateLocations2Options{})
+	require.Len(t, candidates, 1)
+	assert.False(t, candidates[0].UnknownLocation)
+}
+
+// seedStaleKnownLocation writes a knownLocations entry for (transport, scope, blobDigest) with an explicit,
+// possibly backdated, recorded time, bypassing RecordKnownLocation’s use of time.Now(); this is how these tests
+// simulate an entry that has aged past a cache’s MaxAge/PruneOlderThan cutoff.
+func seedStaleKnownLocation(t *testing.T, bdc *cache, transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location string, recordedAt time.Time) {
+	err := bdc.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(knownLocationsBucket)
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(transport.Name()))
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(scope.Opaque))
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(blobDigest.String()))
+		if err != nil {
+			return err
+		}
+		value, err := recordedAt.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(location), value)
+	})
+	require.NoError(t, err)
+}
+
+func TestPruneOlderThan(t *testing.T) {
+	digestOld := testDigest(8)
+	digestNew := testDigest(9)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+
+	bdc := newTestCache(t)
+	seedStaleKnownLocation(t, bdc, transport, scope, digestOld, "locationOld", time.Now().Add(-48*time.Hour))
+	// CandidateLocations2 only returns digests with known compression.
+	bdc.RecordDigestCompressorData(digestNew, blobinfocache.DigestCompressorData{
+		BaseVariantCompressor: blobinfocache.Gzip,
+	})
+	bdc.RecordKnownLocation(transport, scope, digestNew, types.BICLocationReference{Opaque: "locationNew"})
+
+	require.NoError(t, bdc.PruneOlderThan(24*time.Hour))
+
+	assert.Empty(t, bdc.CandidateLocations2(transport, scope, digestOld, blobinfocache.CandidateLocations2Options{}))
+	require.NoError(t, bdc.view(func(tx *bolt.Tx) error {
+		scopeBucket := tx.Bucket(knownLocationsBucket).Bucket([]byte(transport.Name())).Bucket([]byte(scope.Opaque))
+		require.NotNil(t, scopeBucket)
+		assert.Nil(t, scopeBucket.Bucket([]byte(digestOld.String())))
+		return nil
+	}))
+	candidatesNew := bdc.CandidateLocations2(transport, scope, digestNew, blobinfocache.CandidateLocations2Options{})
+	require.Len(t, candidatesNew, 1)
+	assert.False(t, candidatesNew[0].UnknownLocation)
+}
+
+func TestRecordKnownLocationOpportunisticPrune(t *testing.T) {
+	digestOld := testDigest(10)
+	digestNew := testDigest(11)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+
+	bdc := &cache{path: filepath.Join(t.TempDir(), "cache.db"), maxAge: 24 * time.Hour}
+	seedStaleKnownLocation(t, bdc, transport, scope, digestOld, "locationOld", time.Now().Add(-48*time.Hour))
+
+	// An ordinary RecordKnownLocation call touching the same scope should opportunistically prune the stale entry.
+	bdc.RecordKnownLocation(transport, scope, digestNew, types.BICLocationReference{Opaque: "locationNew"})
+
+	assert.Empty(t, bdc.CandidateLocations2(transport, scope, digestOld, blobinfocache.CandidateLocations2Options{}))
+	require.NoError(t, bdc.view(func(tx *bolt.Tx) error {
+		scopeBucket := tx.Bucket(knownLocationsBucket).Bucket([]byte(transport.Name())).Bucket([]byte(scope.Opaque))
+		require.NotNil(t, scopeBucket)
+		assert.Nil(t, scopeBucket.Bucket([]byte(digestOld.String())))
+		return nil
+	}))
+}
+
+// TestRecordKnownLocationOpportunisticPruneReachesEntriesBeyondFirstBudget is a regression test for the
+// opportunistic pruning cursor always restarting at the first opportunisticPruneBudget digests in a scope: with
+// more stale digests than fit in one budget, repeated RecordKnownLocation calls must still eventually reach every
+// one of them, by resuming from where the previous call left off instead of re-scanning the same head-of-cursor
+// entries every time.
+func TestRecordKnownLocationOpportunisticPruneReachesEntriesBeyondFirstBudget(t *testing.T) {
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+	const staleCount = opportunisticPruneBudget + 10
+
+	bdc := &cache{path: filepath.Join(t.TempDir(), "cache.db"), maxAge: 24 * time.Hour}
+	staleDigests := make([]digest.Digest, staleCount)
+	for i := range staleDigests {
+		staleDigests[i] = testDigest(1000 + i)
+		seedStaleKnownLocation(t, bdc, transport, scope, staleDigests[i], "location", time.Now().Add(-48*time.Hour))
+	}
+
+	for i := 0; i < staleCount/opportunisticPruneBudget+2; i++ {
+		bdc.RecordKnownLocation(transport, scope, testDigest(2000+i), types.BICLocationReference{Opaque: "touch"})
+	}
+
+	for _, d := range staleDigests {
+		assert.Emptyf(t, bdc.CandidateLocations2(transport, scope, d, blobinfocache.CandidateLocations2Options{}), "digest %s should have been pruned", d)
+	}
+	require.NoError(t, bdc.view(func(tx *bolt.Tx) error {
+		scopeBucket := tx.Bucket(knownLocationsBucket).Bucket([]byte(transport.Name())).Bucket([]byte(scope.Opaque))
+		require.NotNil(t, scopeBucket)
+		for _, d := range staleDigests {
+			assert.Nilf(t, scopeBucket.Bucket([]byte(d.String())), "digest %s should have been pruned", d)
+		}
+		return nil
+	}))
+}
+
+// seedStaleKnownDigest writes a knownDigestsBucket entry for anyDigest with an explicit, possibly backdated,
+// recorded time, bypassing recordKnownDigest's use of time.Now(); this is how tests simulate a digest that was
+// seen a long time ago and should no longer be suggested as a cross-registry reuse candidate.
+func seedStaleKnownDigest(t *testing.T, bdc *cache, anyDigest digest.Digest, recordedAt time.Time) {
+	err := bdc.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(knownDigestsBucket)
+		if err != nil {
+			return err
+		}
+		value, err := recordedAt.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(anyDigest.String()), value)
+	})
+	require.NoError(t, err)
+}
+
+// TestPruneOlderThanPrunesKnownDigests is a regression test for knownDigestsBucket entries never expiring:
+// without this, a digest that was ever recorded anywhere would be suggested as a cross-registry reuse candidate
+// forever, even long after PruneOlderThan removed every knownLocations entry that justified it.
+func TestPruneOlderThanPrunesKnownDigests(t *testing.T) {
+	digestA := testDigest(22)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoB"}
+
+	bdc := newTestCache(t)
+	seedStaleKnownDigest(t, bdc, digestA, time.Now().Add(-48*time.Hour))
+
+	// Before pruning, a scope that never recorded a location for digestA still gets it suggested as an
+	// unknown-location cross-registry candidate, purely because digestA is present in knownDigestsBucket.
+	require.Len(t, bdc.CandidateLocations2(transport, scope, digestA, blobinfocache.CandidateLocations2Options{}), 1)
+
+	require.NoError(t, bdc.PruneOlderThan(24*time.Hour))
+
+	assert.Empty(t, bdc.CandidateLocations2(transport, scope, digestA, blobinfocache.CandidateLocations2Options{}))
+}
+
+// TestCandidateLocations2SubstitutionSurvivesPruning is a regression test for knownDigestsBucket's freshness gate
+// incorrectly being applied to the unrelated "known compression, no location in this scope" substitution path:
+// a variant digest reached via RecordDigestUncompressedPair, with its own compressor data recorded, must keep
+// being suggested as a substitution candidate even once its knownDigestsBucket entry has aged out, since knowing
+// its compression has nothing to do with cross-registry freshness.
+func TestCandidateLocations2SubstitutionSurvivesPruning(t *testing.T) {
+	digestBase := testDigest(24)
+	digestVariant := testDigest(25)
+	uncompressed := testDigest(26)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+
+	bdc := newTestCache(t)
+	bdc.RecordKnownLocation(transport, scope, digestBase, types.BICLocationReference{Opaque: "locationBase"})
+	bdc.RecordDigestUncompressedPair(digestBase, uncompressed)
+	bdc.RecordDigestUncompressedPair(digestVariant, uncompressed)
+	bdc.RecordDigestCompressorData(digestVariant, blobinfocache.DigestCompressorData{
+		BaseVariantCompressor: blobinfocache.Gzip,
+	})
+	// digestVariant was never touched again, so its knownDigestsBucket entry (written as a side effect of
+	// RecordDigestCompressorData) ages past the cutoff below.
+	seedStaleKnownDigest(t, bdc, digestVariant, time.Now().Add(-48*time.Hour))
+
+	require.NoError(t, bdc.PruneOlderThan(24*time.Hour))
+
+	candidates := bdc.CandidateLocations2(transport, scope, digestBase, blobinfocache.CandidateLocations2Options{CanSubstitute: true})
+	foundVariant := false
+	for _, c := range candidates {
+		if c.Digest == digestVariant {
+			foundVariant = true
+			assert.True(t, c.UnknownLocation)
+		}
+	}
+	assert.True(t, foundVariant, "substitution variant %s should still be suggested after pruning", digestVariant)
+}
+
+func TestLookupOrRecordTOC(t *testing.T) {
+	tocDigest := testDigest(12)
+	uncompressed := testDigest(13)
+
+	bdc := newTestCache(t)
+	var computeCalls int32
+	computeFn := func() (digest.Digest, error) {
+		atomic.AddInt32(&computeCalls, 1)
+		return uncompressed, nil
+	}
+
+	res, err := bdc.LookupOrRecordTOC(tocDigest, computeFn)
+	require.NoError(t, err)
+	assert.Equal(t, uncompressed, res)
+	assert.Equal(t, int32(1), computeCalls)
+
+	// A second call for the same TOC must reuse the recorded value instead of calling computeFn again.
+	res, err = bdc.LookupOrRecordTOC(tocDigest, computeFn)
+	require.NoError(t, err)
+	assert.Equal(t, uncompressed, res)
+	assert.Equal(t, int32(1), computeCalls)
+}
+
+func TestLookupOrRecordTOCConcurrent(t *testing.T) {
+	tocDigest := testDigest(14)
+	uncompressed := testDigest(15)
+	const goroutines = 16
+
+	bdc := newTestCache(t)
+	var computeCalls int32
+	var wg sync.WaitGroup
+	results := make([]digest.Digest, goroutines)
+	errs := make([]error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = bdc.LookupOrRecordTOC(tocDigest, func() (digest.Digest, error) {
+				atomic.AddInt32(&computeCalls, 1)
+				return uncompressed, nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	// Exactly one goroutine should have actually computed the value; every goroutine should still observe it,
+	// because concurrent LookupOrRecordTOC calls for the same (cache, tocDigest) share a single in-flight
+	// computeFn call instead of each computing and recording it independently.
+	assert.Equal(t, int32(1), computeCalls)
+	for i := 0; i < goroutines; i++ {
+		require.NoError(t, errs[i])
+		assert.Equal(t, uncompressed, results[i])
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	digestA := testDigest(16)
+	uncompressedA := testDigest(17)
+	tocA := testDigest(18)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+
+	src := newTestCache(t)
+	src.RecordDigestUncompressedPair(digestA, uncompressedA)
+	src.RecordTOCUncompressedPair(tocA, uncompressedA)
+	src.RecordDigestCompressorData(digestA, blobinfocache.DigestCompressorData{
+		BaseVariantCompressor: blobinfocache.Gzip,
+	})
+	src.RecordKnownLocation(transport, scope, digestA, types.BICLocationReference{Opaque: "locationA"})
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(&buf))
+	require.NotZero(t, buf.Len())
+
+	dst := newTestCache(t)
+	require.NoError(t, dst.Import(bytes.NewReader(buf.Bytes())))
+
+	assert.Equal(t, uncompressedA, dst.UncompressedDigest(digestA))
+	assert.Equal(t, uncompressedA, dst.UncompressedDigestForTOC(tocA))
+	candidates := dst.CandidateLocations2(transport, scope, digestA, blobinfocache.CandidateLocations2Options{})
+	require.Len(t, candidates, 1)
+	assert.False(t, candidates[0].UnknownLocation)
+	assert.Equal(t, types.BICLocationReference{Opaque: "locationA"}, candidates[0].Location)
+
+	// Import must be idempotent: importing the same stream again changes nothing.
+	require.NoError(t, dst.Import(bytes.NewReader(buf.Bytes())))
+	candidates = dst.CandidateLocations2(transport, scope, digestA, blobinfocache.CandidateLocations2Options{})
+	require.Len(t, candidates, 1)
+}
+
+func TestImportKeepsNewestKnownLocation(t *testing.T) {
+	digestA := testDigest(19)
+	transport := fakeTransport("docker")
+	scope := types.BICTransportScope{Opaque: "registry.example/repoA"}
+
+	dst := newTestCache(t)
+	seedStaleKnownLocation(t, dst, transport, scope, digestA, "locationA", time.Now())
+
+	// An import record for the same (transport, scope, digest, location) with an older time must not regress
+	// the already-newer entry.
+	older := time.Now().Add(-24 * time.Hour)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(exportRecord{
+		Version: exportFormatVersion, Kind: exportKindKnownLocation,
+		Transport: transport.Name(), Scope: scope.Opaque, AnyDigest: digestA, Location: "locationA", Time: older,
+	}))
+	require.NoError(t, dst.Import(&buf))
+
+	require.NoError(t, dst.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(knownLocationsBucket).Bucket([]byte(transport.Name())).Bucket([]byte(scope.Opaque)).Bucket([]byte(digestA.String()))
+		require.NotNil(t, b)
+		var recorded time.Time
+		require.NoError(t, recorded.UnmarshalBinary(b.Get([]byte("locationA"))))
+		assert.True(t, recorded.After(older))
+		return nil
+	}))
+}
+
+// TestImportDerivesKnownDigestFreshnessFromRecordTime is a regression test for Import stamping knownDigestsBucket
+// with time.Now() instead of the imported record's own Time: importing an old export must not make every digest
+// in it look freshly-seen for a full maxAge window.
+func TestImportDerivesKnownDigestFreshnessFromRecordTime(t *testing.T) {
+	digestA := testDigest(23)
+	transport := fakeTransport("docker")
+	scopeA := types.BICTransportScope{Opaque: "registry.example/repoA"}
+	scopeB := types.BICTransportScope{Opaque: "registry.example/repoB"}
+
+	dst := newTestCache(t)
+	old := time.Now().Add(-48 * time.Hour)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(exportRecord{
+		Version: exportFormatVersion, Kind: exportKindKnownLocation,
+		Transport: transport.Name(), Scope: scopeA.Opaque, AnyDigest: digestA, Location: "locationA", Time: old,
+	}))
+	require.NoError(t, dst.Import(&buf))
+
+	require.NoError(t, dst.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(knownDigestsBucket)
+		require.NotNil(t, b)
+		var recorded time.Time
+		require.NoError(t, recorded.UnmarshalBinary(b.Get([]byte(digestA.String()))))
+		assert.WithinDuration(t, old, recorded, time.Second)
+		return nil
+	}))
+
+	// scopeB never recorded a location for digestA; right after import it's still suggested cross-registry...
+	require.Len(t, dst.CandidateLocations2(transport, scopeB, digestA, blobinfocache.CandidateLocations2Options{}), 1)
+
+	// ...but once the imported evidence's own age exceeds the cutoff, it must no longer be suggested.
+	require.NoError(t, dst.PruneOlderThan(24*time.Hour))
+	assert.Empty(t, dst.CandidateLocations2(transport, scopeB, digestA, blobinfocache.CandidateLocations2Options{}))
+}
+
+func TestImportSkipsMalformedLines(t *testing.T) {
+	digestA := testDigest(20)
+	uncompressedA := testDigest(21)
+
+	var buf bytes.Buffer
+	buf.WriteString("not json at all\n")
+	enc := json.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(exportRecord{Version: 999, Kind: exportKindUncompressedPair, AnyDigest: digestA, Uncompressed: uncompressedA}))
+	require.NoError(t, enc.Encode(exportRecord{Version: exportFormatVersion, Kind: "bogusKind"}))
+	require.NoError(t, enc.Encode(exportRecord{Version: exportFormatVersion, Kind: exportKindUncompressedPair, AnyDigest: digestA, Uncompressed: uncompressedA}))
+
+	dst := newTestCache(t)
+	require.NoError(t, dst.Import(&buf))
+	assert.Equal(t, uncompressedA, dst.UncompressedDigest(digestA))
+}
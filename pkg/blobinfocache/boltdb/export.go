@@ -0,0 +1,256 @@
+package boltdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containers/image/v5/internal/blobinfocache"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// exportFormatVersion identifies the schema of the JSON-lines stream written by Export and read by Import.
+// Import skips (rather than rejects outright) lines carrying any other version, so that a stream produced by a
+// newer writer can still seed most of an older reader’s cache.
+const exportFormatVersion = 1
+
+// exportRecordKind selects which group of fields in exportRecord is meaningful for a given line.
+type exportRecordKind string
+
+const (
+	exportKindUncompressedPair exportRecordKind = "uncompressedPair"
+	exportKindTOCPair          exportRecordKind = "tocPair"
+	exportKindCompressorData   exportRecordKind = "compressorData"
+	exportKindKnownLocation    exportRecordKind = "knownLocation"
+)
+
+// exportRecord is a single line of the Export/Import JSON-lines stream, covering all four classes of data this
+// cache stores. Exactly one of the field groups below is meaningful, selected by Kind.
+type exportRecord struct {
+	Version int              `json:"version"`
+	Kind    exportRecordKind `json:"kind"`
+
+	// exportKindUncompressedPair, exportKindCompressorData: the digest the rest of the record is about.
+	// exportKindKnownLocation: the blob digest known to exist at Location.
+	AnyDigest digest.Digest `json:"anyDigest,omitempty"`
+	// exportKindUncompressedPair, exportKindTOCPair: the corresponding uncompressed digest.
+	Uncompressed digest.Digest `json:"uncompressed,omitempty"`
+
+	// exportKindTOCPair only.
+	TOCDigest digest.Digest `json:"tocDigest,omitempty"`
+
+	// exportKindCompressorData only.
+	BaseVariantCompressor      string            `json:"baseVariantCompressor,omitempty"`
+	SpecificVariantCompressor  string            `json:"specificVariantCompressor,omitempty"`
+	SpecificVariantAnnotations map[string]string `json:"specificVariantAnnotations,omitempty"`
+
+	// exportKindKnownLocation only.
+	Transport string    `json:"transport,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Time      time.Time `json:"time,omitempty"`
+}
+
+// Export writes a versioned JSON-lines serialization of every uncompressed-digest pair, TOC-to-uncompressed pair,
+// compressor/annotations record, and known location currently stored in the cache to w. The result is meant to be
+// read back with Import, e.g. to pre-seed a cache in CI or to share a warmed cache across build farm workers.
+func (bdc *cache) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return bdc.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(uncompressedDigestBucket); b != nil {
+			if err := b.ForEach(func(k, v []byte) error {
+				anyDigest, err := digest.Parse(string(k))
+				if err != nil {
+					return nil // Ignore unparseable data; this cache wrote it, so this shouldn't happen.
+				}
+				uncompressed, err := digest.Parse(string(v))
+				if err != nil {
+					return nil
+				}
+				return enc.Encode(exportRecord{
+					Version: exportFormatVersion, Kind: exportKindUncompressedPair,
+					AnyDigest: anyDigest, Uncompressed: uncompressed,
+				})
+			}); err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket(uncompressedDigestByTOCBucket); b != nil {
+			if err := b.ForEach(func(k, v []byte) error {
+				tocDigest, err := digest.Parse(string(k))
+				if err != nil {
+					return nil
+				}
+				uncompressed, err := digest.Parse(string(v))
+				if err != nil {
+					return nil
+				}
+				return enc.Encode(exportRecord{
+					Version: exportFormatVersion, Kind: exportKindTOCPair,
+					TOCDigest: tocDigest, Uncompressed: uncompressed,
+				})
+			}); err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket(digestCompressorBucket); b != nil {
+			svBucket := tx.Bucket(digestSpecificVariantCompressorBucket)
+			if err := b.ForEach(func(k, v []byte) error {
+				anyDigest, err := digest.Parse(string(k))
+				if err != nil {
+					return nil
+				}
+				rec := exportRecord{
+					Version: exportFormatVersion, Kind: exportKindCompressorData,
+					AnyDigest: anyDigest, BaseVariantCompressor: string(v),
+				}
+				if svBucket != nil {
+					if svData := svBucket.Get(k); svData != nil {
+						if compressorBytes, annotationBytes, ok := bytes.Cut(svData, []byte{0}); ok {
+							rec.SpecificVariantCompressor = string(compressorBytes)
+							if err := json.Unmarshal(annotationBytes, &rec.SpecificVariantAnnotations); err != nil {
+								return nil
+							}
+						}
+					}
+				}
+				return enc.Encode(rec)
+			}); err != nil {
+				return err
+			}
+		}
+		if top := tx.Bucket(knownLocationsBucket); top != nil {
+			if err := top.ForEach(func(transportKey, tv []byte) error {
+				if tv != nil { // Not a sub-bucket; shouldn't happen in this bucket.
+					return nil
+				}
+				transportBucket := top.Bucket(transportKey)
+				return transportBucket.ForEach(func(scopeKey, sv []byte) error {
+					if sv != nil {
+						return nil
+					}
+					scopeBucket := transportBucket.Bucket(scopeKey)
+					return scopeBucket.ForEach(func(digestKey, dv []byte) error {
+						if dv != nil {
+							return nil
+						}
+						anyDigest, err := digest.Parse(string(digestKey))
+						if err != nil {
+							return nil
+						}
+						digestBucket := scopeBucket.Bucket(digestKey)
+						return digestBucket.ForEach(func(locKey, locVal []byte) error {
+							var t time.Time
+							if err := t.UnmarshalBinary(locVal); err != nil {
+								return nil
+							}
+							return enc.Encode(exportRecord{
+								Version: exportFormatVersion, Kind: exportKindKnownLocation,
+								Transport: string(transportKey), Scope: string(scopeKey),
+								AnyDigest: anyDigest, Location: string(locKey), Time: t,
+							})
+						})
+					})
+				})
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Import reads a stream previously written by Export and merges it into the cache, preserving the same
+// "warn on mismatch, keep newest" semantics as the Record* methods, so running Import more than once (e.g. against
+// an updated warmed-cache export) is safe. Lines that are not valid JSON, carry an unsupported version, or don’t
+// match a known Kind are skipped, with a warning, rather than aborting the whole import.
+func (bdc *cache) Import(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return bdc.update(func(tx *bolt.Tx) error {
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var rec exportRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				logrus.Warnf("Ignoring unparseable blob info cache import record: %v", err)
+				continue
+			}
+			if rec.Version != exportFormatVersion {
+				logrus.Warnf("Ignoring blob info cache import record with unsupported version %d", rec.Version)
+				continue
+			}
+			if err := bdc.importRecord(tx, rec); err != nil {
+				logrus.Warnf("Ignoring invalid blob info cache import record: %v", err)
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// importRecord merges a single exportRecord into the cache within tx.
+func (bdc *cache) importRecord(tx *bolt.Tx, rec exportRecord) error {
+	switch rec.Kind {
+	case exportKindUncompressedPair:
+		return bdc.recordDigestUncompressedPair(tx, rec.AnyDigest, rec.Uncompressed)
+	case exportKindTOCPair:
+		return bdc.recordTOCUncompressedPair(tx, rec.TOCDigest, rec.Uncompressed)
+	case exportKindCompressorData:
+		return bdc.recordDigestCompressorData(tx, rec.AnyDigest, blobinfocache.DigestCompressorData{
+			BaseVariantCompressor:      rec.BaseVariantCompressor,
+			SpecificVariantCompressor:  rec.SpecificVariantCompressor,
+			SpecificVariantAnnotations: rec.SpecificVariantAnnotations,
+		})
+	case exportKindKnownLocation:
+		return bdc.importKnownLocation(tx, rec)
+	default:
+		return fmt.Errorf("unknown blob info cache import record kind %q", rec.Kind)
+	}
+}
+
+// importKnownLocation merges a single knownLocations entry from an Import stream, keeping the existing entry if
+// it is already recorded at least as recently as rec.Time, exactly as concurrent RecordKnownLocation callers
+// would each keep overwriting the stored time with their own, more recent, observation.
+func (bdc *cache) importKnownLocation(tx *bolt.Tx, rec exportRecord) error {
+	b, err := tx.CreateBucketIfNotExists(knownLocationsBucket)
+	if err != nil {
+		return err
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(rec.Transport))
+	if err != nil {
+		return err
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(rec.Scope))
+	if err != nil {
+		return err
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(rec.AnyDigest.String()))
+	if err != nil {
+		return err
+	}
+	key := []byte(rec.Location)
+	if existing := b.Get(key); existing != nil {
+		var t time.Time
+		if err := t.UnmarshalBinary(existing); err == nil && !t.Before(rec.Time) {
+			return nil // The existing entry is already at least as new; nothing to do.
+		}
+	}
+	value, err := rec.Time.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := b.Put(key, value); err != nil {
+		return err
+	}
+	// Use rec.Time, not time.Now(): the freshness marker must reflect how old the imported evidence actually is,
+	// not when it happened to be imported, or importing a stale export would make every digest in it look
+	// freshly-seen for a full maxAge window.
+	return recordKnownDigestAt(tx, rec.AnyDigest, rec.Time)
+}